@@ -0,0 +1,372 @@
+// Command spanloadgen drives SpanWriter.WriteSpan/WriteSpans at a
+// configurable rate so contributors can tune batch size, flush delay and
+// retry parameters against a real ClickHouse instance without needing a
+// full Jaeger deployment. Shard counts are sized by the writer itself and
+// have no flag here.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore"
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore/wal"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func main() {
+	var (
+		dsn          = flag.String("clickhouse-dsn", "", "ClickHouse DSN to write to")
+		indexTable   = flag.String("index-table", "jaeger_index", "index table name")
+		spansTable   = flag.String("spans-table", "jaeger_spans", "spans table name")
+		encoding     = flag.String("encoding", string(clickhousespanstore.EncodingProto), "json or protobuf")
+		compression  = flag.String("compression", string(clickhousespanstore.CompressionNone), "none, zstd, lz4, gzip, or native")
+		rps          = flag.Int("rps", 1000, "sustained write calls per second (each call sends -batch-size spans when -use-write-spans is set)")
+		concurrency  = flag.Int("concurrency", 8, "number of writer goroutines")
+		tenants      = flag.Int("tenants", 1, "number of distinct x-tenant values to synthesize")
+		minSpanBytes = flag.Int("min-span-bytes", 256, "minimum synthesized span tag payload size")
+		maxSpanBytes = flag.Int("max-span-bytes", 2048, "maximum synthesized span tag payload size")
+		rampUp       = flag.Duration("ramp-up", 10*time.Second, "duration to ramp from 0 to -rps")
+		sustained    = flag.Duration("sustained", time.Minute, "duration to hold steady at -rps")
+		burst        = flag.Duration("burst", 0, "duration of a 10x-rps burst appended after -sustained")
+		useBatchAPI  = flag.Bool("use-write-spans", false, "call WriteSpans with a pre-formed batch instead of WriteSpan per-span")
+		batchSize    = flag.Int("batch-size", 20, "batch size when -use-write-spans is set")
+		validate     = flag.Bool("validate", false, "query back a sample of emitted trace IDs after the run")
+		flushSize    = flag.Int64("size", 1000, "SpanWriter batch size: spans per shard flush")
+		flushDelay   = flag.Duration("delay", time.Second, "SpanWriter flush delay")
+		retryTries   = flag.Int("retry-max-attempts", clickhousespanstore.DefaultRetryConfig.MaxAttempts, "attempts per batch INSERT before it goes to the dead-letter table")
+		retryBase    = flag.Duration("retry-base-delay", clickhousespanstore.DefaultRetryConfig.BaseDelay, "backoff before the first retry")
+		retryMax     = flag.Duration("retry-max-delay", clickhousespanstore.DefaultRetryConfig.MaxDelay, "upper bound on the retry backoff")
+	)
+	flag.Parse()
+
+	retryConfig := clickhousespanstore.DefaultRetryConfig
+	retryConfig.MaxAttempts = *retryTries
+	retryConfig.BaseDelay = *retryBase
+	retryConfig.MaxDelay = *retryMax
+
+	logger := hclog.New(&hclog.LoggerOptions{Name: "spanloadgen"})
+
+	if *dsn == "" {
+		logger.Error("missing required -clickhouse-dsn")
+		os.Exit(1)
+	}
+
+	db, err := sql.Open("clickhouse", *dsn)
+	if err != nil {
+		logger.Error("failed to open ClickHouse connection", "error", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	writer, err := clickhousespanstore.NewSpanWriter(
+		logger,
+		db,
+		clickhousespanstore.TableName(*indexTable),
+		clickhousespanstore.TableName(*spansTable),
+		"",
+		clickhousespanstore.Encoding(*encoding),
+		*flushDelay,
+		*flushSize,
+		*concurrency,
+		wal.Config{},
+		retryConfig,
+		clickhousespanstore.OverflowBlock,
+		clickhousespanstore.Compression(*compression),
+	)
+	if err != nil {
+		logger.Error("failed to create span writer", "error", err)
+		os.Exit(1)
+	}
+	defer writer.Close()
+
+	gen := &generator{
+		writer:       writer,
+		logger:       logger,
+		tenants:      *tenants,
+		minSpanBytes: *minSpanBytes,
+		maxSpanBytes: *maxSpanBytes,
+		useBatchAPI:  *useBatchAPI,
+		batchSize:    *batchSize,
+	}
+
+	phases := []phase{
+		{name: "ramp-up", duration: *rampUp, rps: *rps, ramp: true},
+		{name: "sustained", duration: *sustained, rps: *rps},
+	}
+	if *burst > 0 {
+		phases = append(phases, phase{name: "burst", duration: *burst, rps: *rps * 10})
+	}
+
+	var stats runStats
+	traceIDs := gen.run(phases, *concurrency, &stats)
+
+	stats.report(logger)
+	reportFlushCauses(logger)
+
+	if *validate {
+		validateTraceIDs(db, *spansTable, traceIDs, logger)
+	}
+}
+
+type phase struct {
+	name     string
+	duration time.Duration
+	rps      int
+	ramp     bool // linearly ramp from 0 to rps over duration instead of holding steady
+}
+
+type generator struct {
+	writer       *clickhousespanstore.SpanWriter
+	logger       hclog.Logger
+	tenants      int
+	minSpanBytes int
+	maxSpanBytes int
+	useBatchAPI  bool
+	batchSize    int
+}
+
+// runStats accumulates latency samples and outcome counters across every
+// writer goroutine. Latencies are collected in a single slice guarded by a
+// mutex; that's fine at the sample rates this tool is meant to run at.
+type runStats struct {
+	mu        sync.Mutex
+	latencies []time.Duration
+	dropped   int64
+	errors    int64
+	written   int64
+	start     time.Time
+}
+
+func (s *runStats) record(d time.Duration, count int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.errors++
+		return
+	}
+	s.latencies = append(s.latencies, d)
+	s.written += int64(count)
+}
+
+func (s *runStats) report(logger hclog.Logger) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	elapsed := time.Since(s.start)
+	sorted := append([]time.Duration(nil), s.latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	pct := func(p float64) time.Duration {
+		if len(sorted) == 0 {
+			return 0
+		}
+		idx := int(p * float64(len(sorted)-1))
+		return sorted[idx]
+	}
+
+	logger.Info("spanloadgen run complete",
+		"written", s.written,
+		"errors", s.errors,
+		"dropped", atomic.LoadInt64(&s.dropped),
+		"throughput_per_sec", fmt.Sprintf("%.1f", float64(s.written)/elapsed.Seconds()),
+		"p50", pct(0.50),
+		"p95", pct(0.95),
+		"p99", pct(0.99),
+	)
+}
+
+// run executes every phase in order across concurrency goroutines, each
+// self-throttling to phase.rps/concurrency calls per second by sleeping
+// between calls, and
+// returns a sample of the trace IDs it emitted for optional validation.
+func (g *generator) run(phases []phase, concurrency int, stats *runStats) []model.TraceID {
+	stats.start = time.Now()
+
+	var sampledTraceIDs []model.TraceID
+	var sampleMu sync.Mutex
+
+	for _, p := range phases {
+		g.logger.Info("entering phase", "phase", p.name, "rps", p.rps, "duration", p.duration)
+
+		var wg sync.WaitGroup
+		stop := make(chan struct{})
+		perWorkerRPS := float64(p.rps) / float64(concurrency)
+
+		for i := 0; i < concurrency; i++ {
+			wg.Add(1)
+			go func(phaseStart time.Time) {
+				defer wg.Done()
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+
+					rate := perWorkerRPS
+					if p.ramp {
+						frac := time.Since(phaseStart).Seconds() / p.duration.Seconds()
+						if frac > 1 {
+							frac = 1
+						}
+						rate *= frac
+					}
+					if rate <= 0 {
+						time.Sleep(10 * time.Millisecond)
+						continue
+					}
+
+					start := time.Now()
+					sent, err := g.write()
+					stats.record(time.Since(start), len(sent), err)
+					if err != nil {
+						atomic.AddInt64(&stats.dropped, 1)
+					}
+
+					sampleMu.Lock()
+					for _, span := range sent {
+						if len(sampledTraceIDs) >= 100 {
+							break
+						}
+						sampledTraceIDs = append(sampledTraceIDs, span.TraceID)
+					}
+					sampleMu.Unlock()
+
+					time.Sleep(time.Duration(float64(time.Second) / rate))
+				}
+			}(time.Now())
+		}
+
+		time.Sleep(p.duration)
+		close(stop)
+		wg.Wait()
+	}
+
+	return sampledTraceIDs
+}
+
+// write synthesizes the span(s) for one call and sends them through the
+// configured API, returning exactly the spans it sent so the caller samples
+// and counts the ones that actually went out, not ones it never wrote.
+func (g *generator) write() ([]*model.Span, error) {
+	ctx := context.Background()
+	tenant := fmt.Sprintf("tenant-%d", rand.Intn(g.tenants))
+	ctx = metadata.NewIncomingContext(ctx, metadata.Pairs("x-tenant", tenant))
+
+	if g.useBatchAPI {
+		batch := make([]*model.Span, g.batchSize)
+		for i := range batch {
+			batch[i] = g.synthesizeSpan()
+		}
+		if err := g.writer.WriteSpans(ctx, batch); err != nil {
+			return nil, err
+		}
+		return batch, nil
+	}
+
+	span := g.synthesizeSpan()
+	if err := g.writer.WriteSpan(ctx, span); err != nil {
+		return nil, err
+	}
+	return []*model.Span{span}, nil
+}
+
+func (g *generator) synthesizeSpan() *model.Span {
+	size := g.minSpanBytes
+	if g.maxSpanBytes > g.minSpanBytes {
+		size += rand.Intn(g.maxSpanBytes - g.minSpanBytes)
+	}
+
+	return &model.Span{
+		TraceID:       model.NewTraceID(rand.Uint64(), rand.Uint64()),
+		SpanID:        model.NewSpanID(rand.Uint64()),
+		OperationName: "spanloadgen-op",
+		StartTime:     time.Now(),
+		Duration:      time.Duration(rand.Intn(int(time.Second))),
+		Tags: []model.KeyValue{
+			model.String("payload", randomString(size)),
+		},
+		Process: &model.Process{ServiceName: "spanloadgen"},
+	}
+}
+
+func randomString(n int) string {
+	const alphabet = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = alphabet[rand.Intn(len(alphabet))]
+	}
+	return string(b)
+}
+
+// validateTraceIDs queries the spans table for each sampled trace ID and
+// logs how many were actually found, as a cheap durability check after a
+// run.
+func validateTraceIDs(db *sql.DB, spansTable string, traceIDs []model.TraceID, logger hclog.Logger) {
+	found := 0
+	for _, id := range traceIDs {
+		row := db.QueryRow(fmt.Sprintf("SELECT count() FROM %s WHERE traceID = ?", spansTable), id.String())
+		var count int
+		if err := row.Scan(&count); err != nil {
+			logger.Error("validation query failed", "trace_id", id, "error", err)
+			continue
+		}
+		if count > 0 {
+			found++
+		}
+	}
+	logger.Info("validation complete", "sampled", len(traceIDs), "found", found)
+}
+
+// reportFlushCauses reads the jaeger_clickhouse_writes_with_* counters the
+// SpanWriter already registers and logs the ratio of flushes caused by
+// hitting the batch size versus the flush interval timer.
+func reportFlushCauses(logger hclog.Logger) {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		logger.Error("failed to gather flush-cause metrics", "error", err)
+		return
+	}
+
+	var bySize, byInterval float64
+	for _, mf := range families {
+		switch mf.GetName() {
+		case "jaeger_clickhouse_writes_with_batch_size_total":
+			bySize = counterValue(mf.GetMetric())
+		case "jaeger_clickhouse_writes_with_flush_interval_total":
+			byInterval = counterValue(mf.GetMetric())
+		}
+	}
+
+	total := bySize + byInterval
+	if total == 0 {
+		logger.Info("no flushes recorded")
+		return
+	}
+	logger.Info("batch-flush cause ratio",
+		"by_size_pct", fmt.Sprintf("%.1f", 100*bySize/total),
+		"by_interval_pct", fmt.Sprintf("%.1f", 100*byInterval/total),
+	)
+}
+
+func counterValue(metrics []*dto.Metric) float64 {
+	if len(metrics) == 0 {
+		return 0
+	}
+	return metrics[0].GetCounter().GetValue()
+}
@@ -0,0 +1,142 @@
+package clickhousespanstore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"sync"
+
+	"github.com/klauspost/compress/lz4"
+	"github.com/klauspost/compress/zstd"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Compression selects how a batch's encoded spans are compressed before
+// being handed to the ClickHouse driver.
+type Compression string
+
+const (
+	// CompressionNone sends the encoded batch as-is.
+	CompressionNone Compression = "none"
+	// CompressionZstd compresses with zstd, the best ratio/CPU tradeoff
+	// of the supported codecs for span-shaped data.
+	CompressionZstd Compression = "zstd"
+	// CompressionLZ4 trades ratio for lower CPU than zstd.
+	CompressionLZ4 Compression = "lz4"
+	// CompressionGzip is provided for operators standardized on gzip
+	// elsewhere in their pipeline.
+	CompressionGzip Compression = "gzip"
+	// CompressionNative skips client-side compression entirely and
+	// relies on the column-level codec configured on the ClickHouse DSN.
+	CompressionNative Compression = "native"
+)
+
+// Encoder compresses src and appends the result to dst, returning the
+// extended slice. It mirrors the small encoder interface used by
+// structured log shippers, so a codec can be swapped in without touching
+// callers.
+type Encoder interface {
+	EncodeAll(src, dst []byte) []byte
+}
+
+// NewEncoder returns the Encoder for the given Compression, or nil for
+// CompressionNone and CompressionNative, both of which skip client-side
+// compression entirely.
+func NewEncoder(c Compression) (Encoder, error) {
+	switch c {
+	case "", CompressionNone, CompressionNative:
+		return nil, nil
+	case CompressionZstd:
+		return newZstdEncoder()
+	case CompressionLZ4:
+		return lz4Encoder{}, nil
+	case CompressionGzip:
+		return gzipEncoder{}, nil
+	default:
+		return nil, fmt.Errorf("clickhousespanstore: unknown compression %q", c)
+	}
+}
+
+type zstdEncoder struct {
+	enc *zstd.Encoder
+}
+
+func newZstdEncoder() (Encoder, error) {
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		return nil, fmt.Errorf("clickhousespanstore: create zstd encoder: %w", err)
+	}
+	return zstdEncoder{enc: enc}, nil
+}
+
+func (z zstdEncoder) EncodeAll(src, dst []byte) []byte {
+	return z.enc.EncodeAll(src, dst)
+}
+
+type lz4Encoder struct{}
+
+func (lz4Encoder) EncodeAll(src, dst []byte) []byte {
+	var buf bytes.Buffer
+	w := lz4.NewWriter(&buf)
+	_, _ = w.Write(src)
+	_ = w.Close()
+	return append(dst, buf.Bytes()...)
+}
+
+type gzipEncoder struct{}
+
+func (gzipEncoder) EncodeAll(src, dst []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, _ = w.Write(src)
+	_ = w.Close()
+	return append(dst, buf.Bytes()...)
+}
+
+var (
+	batchBytesPreCompression = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "jaeger_clickhouse_batch_bytes_pre_compression",
+		Help:    "Size in bytes of an encoded span batch before compression",
+		Buckets: prometheus.ExponentialBuckets(1024, 2, 12),
+	})
+	batchBytesPostCompression = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "jaeger_clickhouse_batch_bytes_post_compression",
+		Help:    "Size in bytes of an encoded span batch after compression",
+		Buckets: prometheus.ExponentialBuckets(1024, 2, 12),
+	})
+	compressionErrorsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "jaeger_clickhouse_compression_errors_total",
+		Help: "Number of batches that failed to compress and were sent uncompressed",
+	})
+)
+
+var registerCompressionMetrics sync.Once
+
+// compressBatch encodes payload with enc, recording the pre/post size
+// histograms. A nil enc (CompressionNone / CompressionNative) returns
+// payload unchanged. A codec that panics mid-encode (e.g. a corrupt
+// internal encoder state) falls back to sending the batch uncompressed
+// rather than losing it.
+func compressBatch(enc Encoder, payload []byte) (out []byte) {
+	registerCompressionMetrics.Do(func() {
+		prometheus.MustRegister(batchBytesPreCompression, batchBytesPostCompression, compressionErrorsTotal)
+	})
+
+	batchBytesPreCompression.Observe(float64(len(payload)))
+	defer func() {
+		batchBytesPostCompression.Observe(float64(len(out)))
+	}()
+
+	if enc == nil {
+		return payload
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			compressionErrorsTotal.Inc()
+			out = payload
+		}
+	}()
+
+	return enc.EncodeAll(payload, nil)
+}
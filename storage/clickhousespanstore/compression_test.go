@@ -0,0 +1,106 @@
+package clickhousespanstore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+
+	"github.com/klauspost/compress/lz4"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestCompressBatchRoundTrip(t *testing.T) {
+	payload := bytes.Repeat([]byte("jaeger-clickhouse span batch payload "), 64)
+
+	tests := []struct {
+		name    string
+		c       Compression
+		decode  func(t *testing.T, compressed []byte) []byte
+	}{
+		{
+			name: "zstd",
+			c:    CompressionZstd,
+			decode: func(t *testing.T, compressed []byte) []byte {
+				dec, err := zstd.NewReader(nil)
+				if err != nil {
+					t.Fatalf("zstd.NewReader: %v", err)
+				}
+				defer dec.Close()
+				out, err := dec.DecodeAll(compressed, nil)
+				if err != nil {
+					t.Fatalf("zstd decode: %v", err)
+				}
+				return out
+			},
+		},
+		{
+			name: "lz4",
+			c:    CompressionLZ4,
+			decode: func(t *testing.T, compressed []byte) []byte {
+				out, err := io.ReadAll(lz4.NewReader(bytes.NewReader(compressed)))
+				if err != nil {
+					t.Fatalf("lz4 decode: %v", err)
+				}
+				return out
+			},
+		},
+		{
+			name: "gzip",
+			c:    CompressionGzip,
+			decode: func(t *testing.T, compressed []byte) []byte {
+				r, err := gzip.NewReader(bytes.NewReader(compressed))
+				if err != nil {
+					t.Fatalf("gzip.NewReader: %v", err)
+				}
+				defer r.Close()
+				out, err := io.ReadAll(r)
+				if err != nil {
+					t.Fatalf("gzip decode: %v", err)
+				}
+				return out
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			enc, err := NewEncoder(tt.c)
+			if err != nil {
+				t.Fatalf("NewEncoder(%s): %v", tt.c, err)
+			}
+
+			compressed := compressBatch(enc, payload)
+			decoded := tt.decode(t, compressed)
+
+			if !bytes.Equal(decoded, payload) {
+				t.Fatalf("%s round-trip mismatch: got %d bytes, want %d bytes", tt.name, len(decoded), len(payload))
+			}
+		})
+	}
+}
+
+func TestCompressBatchNoneAndNativePassThrough(t *testing.T) {
+	payload := []byte("uncompressed payload")
+
+	for _, c := range []Compression{CompressionNone, CompressionNative, ""} {
+		enc, err := NewEncoder(c)
+		if err != nil {
+			t.Fatalf("NewEncoder(%q): %v", c, err)
+		}
+		if enc != nil {
+			t.Fatalf("NewEncoder(%q) should return a nil Encoder, got %T", c, enc)
+		}
+
+		out := compressBatch(enc, payload)
+		if !bytes.Equal(out, payload) {
+			t.Fatalf("compressBatch with a nil Encoder should pass payload through unchanged, got %q", out)
+		}
+	}
+}
+
+func TestNewEncoderUnknownCompression(t *testing.T) {
+	if _, err := NewEncoder(Compression("bogus")); err == nil {
+		t.Fatalf("expected an error for an unknown compression codec")
+	}
+}
@@ -0,0 +1,621 @@
+package clickhousespanstore
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore/wal"
+)
+
+const (
+	// shardUpdateDuration is how often we recompute the desired shard count
+	// for every tenant from its EWMA samples.
+	shardUpdateDuration = 10 * time.Second
+
+	// ewmaAlpha is the smoothing factor applied to the in/out rate and
+	// queue-depth samples used to size each tenant's shard pool.
+	ewmaAlpha = 0.7
+
+	// shardResizeCooldown is the minimum time between two resizes of the
+	// same tenant, so a single burst cannot cause repeated churn.
+	shardResizeCooldown = 30 * time.Second
+
+	// shardHysteresis is the largest difference between the desired and
+	// current shard count that is tolerated without resizing; only a
+	// larger difference triggers a resize.
+	shardHysteresis = 1
+
+	// defaultOutRatePerShard is the assumed steady-state drain rate of a
+	// single shard, used until we have observed samples of our own.
+	defaultOutRatePerShard = 500.0
+
+	// desiredDrainTime is the backlog drain time the bias term aims for.
+	desiredDrainTime = 5 * time.Second
+)
+
+// OverflowPolicy decides what Enqueue does when a span's shard channel is
+// already full.
+type OverflowPolicy string
+
+const (
+	// OverflowBlock blocks the caller until the shard has room, applying
+	// backpressure all the way up to the gRPC handler.
+	OverflowBlock OverflowPolicy = "block"
+	// OverflowDropNewest discards the span being enqueued.
+	OverflowDropNewest OverflowPolicy = "drop_newest"
+	// OverflowDropOldest discards the oldest queued span to make room.
+	OverflowDropOldest OverflowPolicy = "drop_oldest"
+)
+
+// QueueManager owns one shard set per tenant and periodically resizes each
+// tenant's shard count based on an EWMA of its observed load. This mirrors
+// the Prometheus remote-write queue manager: noisy tenants grow their own
+// shards instead of starving everyone else on a single shared queue.
+type QueueManager struct {
+	logger       hclog.Logger
+	workerParams WorkerParams
+	maxSpanCount int
+	batchSize    int64
+	wal          *wal.Writer
+	retryConfig  RetryConfig
+	dlq          *dlqWriter
+	overflowPolicy OverflowPolicy
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	tenants map[string]*tenantQueue
+	done    sync.WaitGroup
+	stop    chan struct{}
+
+	// inflight counts Enqueue/TryEnqueue calls currently sending on a shard
+	// channel. Close must wait for it to drain before closing any shard's
+	// channel, or a send racing with that close panics.
+	inflight sync.WaitGroup
+
+	// shardsDone counts currently running drainShard goroutines. Close
+	// waits for it to reach zero - meaning every shard's final flush has
+	// actually been attempted - before cancelling qm.ctx.
+	shardsDone sync.WaitGroup
+}
+
+// tenantQueue holds the live shards and EWMA state for a single tenant.
+type tenantQueue struct {
+	tenant  string
+	pool    *WorkerPool
+	retrier *retryingWriter
+
+	mu         sync.Mutex
+	shards     []*shard
+	lastResize time.Time
+
+	// inCount/outCount are raw event counts accumulated since lastSample;
+	// rescaleTenant divides them by the elapsed time to get a rate sample
+	// before folding it into the inRate/outRate EWMAs.
+	inCount    int64
+	outCount   int64
+	lastSample time.Time
+
+	inRate   ewma
+	outRate  ewma
+	queueLen ewma
+
+	metrics tenantMetrics
+}
+
+// shard is a single drain goroutine batching spans into the tenant's
+// WorkerPool.
+type shard struct {
+	spans  chan SpanAndTenant
+	finish chan struct{}
+
+	// redirectTo is set by resizeLocked before finish is closed: any spans
+	// still queued on this shard when it stops are forwarded there instead
+	// of being flushed, so a shrink never drops spans in flight.
+	redirectTo *shard
+}
+
+// ewma is a minimal exponentially-weighted moving average.
+type ewma struct {
+	value float64
+	set   bool
+}
+
+func (e *ewma) update(sample float64) float64 {
+	if !e.set {
+		e.value = sample
+		e.set = true
+	} else {
+		e.value = ewmaAlpha*sample + (1-ewmaAlpha)*e.value
+	}
+	return e.value
+}
+
+type tenantMetrics struct {
+	shards  prometheus.Gauge
+	qLen    prometheus.Gauge
+	inRate  prometheus.Gauge
+	outRate prometheus.Gauge
+}
+
+var (
+	numWritesWithBatchSize = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "jaeger_clickhouse_writes_with_batch_size_total",
+		Help: "Number of clickhouse writes due to batch size criteria",
+	})
+	numWritesWithFlushInterval = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "jaeger_clickhouse_writes_with_flush_interval_total",
+		Help: "Number of clickhouse writes due to flush interval criteria",
+	})
+
+	tenantShardsGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "jaeger_clickhouse_tenant_shards",
+		Help: "Current number of shards for a tenant's write queue",
+	}, []string{"tenant"})
+	tenantQueueLenGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "jaeger_clickhouse_tenant_queue_length",
+		Help: "Current queued spans for a tenant across all shards",
+	}, []string{"tenant"})
+	tenantInRateGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "jaeger_clickhouse_tenant_spans_in_rate",
+		Help: "EWMA of spans enqueued per second for a tenant",
+	}, []string{"tenant"})
+	tenantOutRateGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "jaeger_clickhouse_tenant_spans_out_rate",
+		Help: "EWMA of spans written per second for a tenant",
+	}, []string{"tenant"})
+	spansDroppedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "jaeger_clickhouse_spans_dropped_total",
+		Help: "Number of spans dropped due to queue overflow, by tenant and overflow policy",
+	}, []string{"tenant", "policy"})
+)
+
+var registerQueueManagerMetrics sync.Once
+
+func registerQueueMetrics() {
+	registerQueueManagerMetrics.Do(func() {
+		prometheus.MustRegister(numWritesWithBatchSize)
+		prometheus.MustRegister(numWritesWithFlushInterval)
+		prometheus.MustRegister(tenantShardsGauge)
+		prometheus.MustRegister(tenantQueueLenGauge)
+		prometheus.MustRegister(tenantInRateGauge)
+		prometheus.MustRegister(tenantOutRateGauge)
+		prometheus.MustRegister(spansDroppedCounter)
+	})
+}
+
+// NewQueueManager builds an (initially empty) per-tenant queue manager.
+// Tenants are created lazily, on first write, via getOrCreateTenant.
+func NewQueueManager(
+	workerParams WorkerParams,
+	maxSpanCount int,
+	batchSize int64,
+	walWriter *wal.Writer,
+	retryConfig RetryConfig,
+	overflowPolicy OverflowPolicy,
+) *QueueManager {
+	registerQueueMetrics()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	qm := &QueueManager{
+		logger:         workerParams.logger,
+		workerParams:   workerParams,
+		maxSpanCount:   maxSpanCount,
+		batchSize:      batchSize,
+		wal:            walWriter,
+		retryConfig:    retryConfig,
+		dlq:            newDLQWriter(workerParams.db, workerParams.spansTable),
+		overflowPolicy: overflowPolicy,
+		ctx:            ctx,
+		cancel:         cancel,
+		tenants:        make(map[string]*tenantQueue),
+		stop:           make(chan struct{}),
+	}
+
+	qm.done.Add(1)
+	go qm.rescaleLoop()
+
+	return qm
+}
+
+// Enqueue routes a span to its tenant's shard set, starting the tenant's
+// shards on first use. Callers must not call Enqueue/TryEnqueue/WriteSpan
+// concurrently with or after Close, the same contract as any other Closer.
+func (qm *QueueManager) Enqueue(st SpanAndTenant) {
+	qm.inflight.Add(1)
+	defer qm.inflight.Done()
+
+	s, tq := qm.shardFor(st)
+
+	switch qm.overflowPolicy {
+	case OverflowDropNewest:
+		select {
+		case s.spans <- st:
+		default:
+			spansDroppedCounter.WithLabelValues(tq.tenant, string(OverflowDropNewest)).Inc()
+			qm.ackDropped(st)
+		}
+	case OverflowDropOldest:
+		select {
+		case s.spans <- st:
+		default:
+			select {
+			case evicted := <-s.spans:
+				spansDroppedCounter.WithLabelValues(tq.tenant, string(OverflowDropOldest)).Inc()
+				qm.ackDropped(evicted)
+			default:
+			}
+			s.spans <- st
+		}
+	default: // OverflowBlock
+		s.spans <- st
+	}
+}
+
+// TryEnqueue behaves like Enqueue but never blocks: it returns an error
+// immediately if the span's shard is full, regardless of the configured
+// overflow policy, so callers that want to implement their own
+// backpressure (e.g. an OTLP batch receiver) can do so.
+func (qm *QueueManager) TryEnqueue(st SpanAndTenant) error {
+	qm.inflight.Add(1)
+	defer qm.inflight.Done()
+
+	s, tq := qm.shardFor(st)
+
+	select {
+	case s.spans <- st:
+		return nil
+	default:
+		spansDroppedCounter.WithLabelValues(tq.tenant, "try").Inc()
+		qm.ackDropped(st)
+		return fmt.Errorf("clickhousespanstore: queue full for tenant %q", tq.tenant)
+	}
+}
+
+// EnqueueBatch writes a pre-formed batch of spans for tenant straight to the
+// tenant's WorkerPool as a single INSERT, bypassing the per-span shard
+// channel and its own size/timer-based batching entirely. This is what
+// WriteSpans uses so a batch that already arrived as a batch doesn't pay
+// the per-span channel roundtrip, and reaches the pool as one unit instead
+// of N. Because it writes synchronously rather than queueing, the
+// configured OverflowPolicy does not apply here - there is no queue for it
+// to police.
+func (qm *QueueManager) EnqueueBatch(tenant string, batch []SpanAndTenant) error {
+	if len(batch) == 0 {
+		return nil
+	}
+
+	qm.inflight.Add(1)
+	defer qm.inflight.Done()
+
+	tq := qm.getOrCreateTenant(tenant)
+
+	atomic.AddInt64(&tq.inCount, int64(len(batch)))
+	err := tq.retrier.WriteBatch(qm.ctx, batch)
+	atomic.AddInt64(&tq.outCount, int64(len(batch)))
+
+	if err == nil && qm.wal != nil {
+		for _, span := range batch {
+			if ackErr := qm.wal.Ack(span.walRef, 1); ackErr != nil {
+				qm.logger.Error("Failed to ack WAL record", "tenant", tenant, "error", ackErr)
+			}
+		}
+	}
+
+	return err
+}
+
+// ackDropped acks st's WAL record (if any) immediately when Enqueue or
+// TryEnqueue decides not to hand it to a shard. Without this, a span
+// dropped under an overflow policy stays un-truncated in the WAL and gets
+// replayed - and re-delivered to ClickHouse - on the next restart, even
+// though the operator explicitly configured it to be dropped.
+func (qm *QueueManager) ackDropped(st SpanAndTenant) {
+	if qm.wal == nil {
+		return
+	}
+	if err := qm.wal.Ack(st.walRef, 1); err != nil {
+		qm.logger.Error("Failed to ack dropped span's WAL record", "error", err)
+	}
+}
+
+// shardFor picks the shard a span is routed to. The index is derived from
+// the span's trace ID rather than the tenant (which is constant for every
+// call here) so that, once a tenant has more than one shard, traffic
+// actually spreads across all of them instead of piling onto one.
+func (qm *QueueManager) shardFor(st SpanAndTenant) (*shard, *tenantQueue) {
+	tq := qm.getOrCreateTenant(st.tenant)
+
+	tq.mu.Lock()
+	s := tq.shards[int(spanHash(st.span)%uint64(len(tq.shards)))]
+	tq.mu.Unlock()
+
+	atomic.AddInt64(&tq.inCount, 1)
+
+	return s, tq
+}
+
+func (qm *QueueManager) getOrCreateTenant(tenant string) *tenantQueue {
+	qm.mu.Lock()
+	defer qm.mu.Unlock()
+
+	if tq, ok := qm.tenants[tenant]; ok {
+		return tq
+	}
+
+	params := qm.workerParams
+	params.tenant = tenant
+	pool := NewWorkerPool(&params, qm.maxSpanCount)
+	go pool.Work()
+
+	tq := &tenantQueue{
+		tenant:     tenant,
+		pool:       pool,
+		retrier:    newRetryingWriter(pool, qm.dlq, qm.retryConfig, qm.logger, qm.workerParams.encoding, qm.workerParams.encoder),
+		lastSample: time.Now(),
+		metrics: tenantMetrics{
+			shards:  tenantShardsGauge.WithLabelValues(tenant),
+			qLen:    tenantQueueLenGauge.WithLabelValues(tenant),
+			inRate:  tenantInRateGauge.WithLabelValues(tenant),
+			outRate: tenantOutRateGauge.WithLabelValues(tenant),
+		},
+	}
+	tq.shards = append(tq.shards, qm.newShard(tq))
+	tq.metrics.shards.Set(1)
+
+	qm.tenants[tenant] = tq
+	return tq
+}
+
+func (qm *QueueManager) newShard(tq *tenantQueue) *shard {
+	s := &shard{
+		spans:  make(chan SpanAndTenant, qm.batchSize),
+		finish: make(chan struct{}),
+	}
+	qm.shardsDone.Add(1)
+	go qm.drainShard(tq, s)
+	return s
+}
+
+// drainShard batches spans off a single shard channel and flushes them
+// to the tenant's WorkerPool by size or by the configured flush delay.
+func (qm *QueueManager) drainShard(tq *tenantQueue, s *shard) {
+	defer qm.shardsDone.Done()
+
+	batch := make([]SpanAndTenant, 0, qm.batchSize)
+	timer := time.NewTimer(qm.workerParams.delay)
+	defer timer.Stop()
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		err := tq.retrier.WriteBatch(qm.ctx, batch)
+		atomic.AddInt64(&tq.outCount, int64(len(batch)))
+
+		if err == nil && qm.wal != nil {
+			for _, span := range batch {
+				if ackErr := qm.wal.Ack(span.walRef, 1); ackErr != nil {
+					qm.logger.Error("Failed to ack WAL record", "tenant", tq.tenant, "error", ackErr)
+				}
+			}
+		}
+
+		batch = make([]SpanAndTenant, 0, qm.batchSize)
+	}
+
+	for {
+		select {
+		case span, ok := <-s.spans:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, span)
+			if int64(len(batch)) == qm.batchSize {
+				qm.logger.Debug("Flush due to batch size", "tenant", tq.tenant, "size", len(batch))
+				numWritesWithBatchSize.Inc()
+				flush()
+			}
+		case <-timer.C:
+			if len(batch) > 0 {
+				qm.logger.Debug("Flush due to timer", "tenant", tq.tenant)
+				numWritesWithFlushInterval.Inc()
+			}
+			flush()
+			timer.Reset(qm.workerParams.delay)
+		case <-s.finish:
+			// Forward whatever is already queued to the surviving shard
+			// resizeLocked picked, instead of flushing it ourselves, so a
+			// shrink never drops spans that hadn't been batched yet.
+			for _, span := range batch {
+				s.redirectTo.spans <- span
+			}
+			for {
+				select {
+				case span := <-s.spans:
+					s.redirectTo.spans <- span
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// rescaleLoop recomputes the desired shard count for every known tenant
+// every shardUpdateDuration and resizes those that drifted past the
+// hysteresis threshold and cooldown window.
+func (qm *QueueManager) rescaleLoop() {
+	defer qm.done.Done()
+
+	ticker := time.NewTicker(shardUpdateDuration)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			qm.rescaleAll()
+		case <-qm.stop:
+			return
+		}
+	}
+}
+
+func (qm *QueueManager) rescaleAll() {
+	qm.mu.Lock()
+	tenants := make([]*tenantQueue, 0, len(qm.tenants))
+	for _, tq := range qm.tenants {
+		tenants = append(tenants, tq)
+	}
+	qm.mu.Unlock()
+
+	for _, tq := range tenants {
+		qm.rescaleTenant(tq)
+	}
+}
+
+func (qm *QueueManager) rescaleTenant(tq *tenantQueue) {
+	tq.mu.Lock()
+	defer tq.mu.Unlock()
+
+	queued := 0
+	for _, s := range tq.shards {
+		queued += len(s.spans)
+	}
+	qLen := tq.queueLen.update(float64(queued))
+
+	elapsed := time.Since(tq.lastSample).Seconds()
+	tq.lastSample = time.Now()
+	if elapsed <= 0 {
+		elapsed = shardUpdateDuration.Seconds()
+	}
+	inSample := float64(atomic.SwapInt64(&tq.inCount, 0)) / elapsed
+	outSample := float64(atomic.SwapInt64(&tq.outCount, 0)) / elapsed
+
+	inRate := tq.inRate.update(inSample)
+	outRate := tq.outRate.update(outSample)
+
+	tq.metrics.qLen.Set(float64(queued))
+	tq.metrics.inRate.Set(inRate)
+	tq.metrics.outRate.Set(outRate)
+
+	current := len(tq.shards)
+	outRatePerShard := outRate / float64(current)
+	if outRatePerShard <= 0 {
+		outRatePerShard = defaultOutRatePerShard
+	}
+
+	bias := qLen / desiredDrainTime.Seconds()
+	desired := int(ceilDiv(inRate+bias, outRatePerShard))
+	if desired < 1 {
+		desired = 1
+	}
+
+	if abs(desired-current) <= shardHysteresis {
+		return
+	}
+	if time.Since(tq.lastResize) < shardResizeCooldown {
+		return
+	}
+
+	qm.logger.Info("Resizing tenant shards", "tenant", tq.tenant, "from", current, "to", desired)
+	qm.resizeLocked(tq, desired)
+	tq.lastResize = time.Now()
+	tq.metrics.shards.Set(float64(desired))
+}
+
+// resizeLocked grows or shrinks tq.shards to the desired count. Shrinking
+// drains the removed shards' pending batches into the first surviving
+// shard, tq.shards[0], so no spans in flight are lost.
+func (qm *QueueManager) resizeLocked(tq *tenantQueue, desired int) {
+	current := len(tq.shards)
+	switch {
+	case desired > current:
+		for i := current; i < desired; i++ {
+			tq.shards = append(tq.shards, qm.newShard(tq))
+		}
+	case desired < current:
+		removed := tq.shards[desired:]
+		tq.shards = tq.shards[:desired]
+		survivor := tq.shards[0]
+		for _, s := range removed {
+			s.redirectTo = survivor
+			close(s.finish)
+		}
+	}
+}
+
+// Close stops the rescale loop and every tenant's shards and worker pool,
+// flushing any pending batches first. qm.ctx is only cancelled once every
+// shard's final flush has actually been attempted: cancelling it any
+// earlier would make that flush's retryingWriter.WriteBatch fail on
+// ctx.Err() before even trying the write, silently dropping a clean batch
+// on every graceful shutdown instead of draining it.
+func (qm *QueueManager) Close() {
+	close(qm.stop)
+	qm.done.Wait()
+
+	// Wait for every in-flight Enqueue/TryEnqueue call to finish before
+	// closing any shard's channel: closing a channel while a goroutine is
+	// still sending on it panics with "send on closed channel".
+	qm.inflight.Wait()
+
+	qm.mu.Lock()
+	tenants := make([]*tenantQueue, 0, len(qm.tenants))
+	for _, tq := range qm.tenants {
+		tenants = append(tenants, tq)
+	}
+	qm.mu.Unlock()
+
+	for _, tq := range tenants {
+		tq.mu.Lock()
+		for _, s := range tq.shards {
+			close(s.spans)
+		}
+		tq.mu.Unlock()
+	}
+
+	// Every shard's drainShard goroutine is now flushing (or has flushed)
+	// whatever it had queued. Only cancel qm.ctx once that is done.
+	qm.shardsDone.Wait()
+	qm.cancel()
+
+	for _, tq := range tenants {
+		tq.pool.Close()
+	}
+}
+
+func ceilDiv(a, b float64) float64 {
+	if b == 0 {
+		return a
+	}
+	q := a / b
+	if q != float64(int64(q)) {
+		return float64(int64(q) + 1)
+	}
+	return q
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// spanHash derives a per-span value used to pick a shard within a tenant's
+// shard set. Hashing the trace ID (rather than anything tenant-level)
+// means spans spread across every shard while spans of the same trace
+// still land together.
+func spanHash(span *model.Span) uint64 {
+	return span.TraceID.High ^ span.TraceID.Low
+}
@@ -0,0 +1,61 @@
+package clickhousespanstore
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// TestCloseCancelsContextAfterShardsFlush guards against a regression where
+// Close cancelled qm.ctx before the shards' final flush had a chance to run:
+// that made retryingWriter.WriteBatch fail on ctx.Err() before even
+// attempting the write, so a batch still queued at Close time was dropped on
+// every clean shutdown. drainShard itself needs a real *WorkerPool to flush
+// through (not available in this tree), so this test stands in a fake drain
+// goroutine shaped like drainShard's shutdown path and asserts it observes
+// qm.ctx still live when it runs, before Close cancels it.
+func TestCloseCancelsContextAfterShardsFlush(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	qm := &QueueManager{
+		batchSize:      8,
+		overflowPolicy: OverflowBlock,
+		ctx:            ctx,
+		cancel:         cancel,
+		tenants:        make(map[string]*tenantQueue),
+		stop:           make(chan struct{}),
+	}
+
+	tq := &tenantQueue{tenant: "acme", lastSample: time.Now()}
+	s := &shard{spans: make(chan SpanAndTenant, 8), finish: make(chan struct{})}
+	tq.shards = append(tq.shards, s)
+	qm.tenants["acme"] = tq
+
+	ctxLiveAtFlush := make(chan bool, 1)
+	qm.shardsDone.Add(1)
+	go func() {
+		defer qm.shardsDone.Done()
+		// Mirrors drainShard's shutdown case: it only learns the channel
+		// closed, then does its final flush against qm.ctx.
+		for range s.spans {
+		}
+		ctxLiveAtFlush <- qm.ctx.Err() == nil
+	}()
+
+	// Recover from the nil *WorkerPool.Close() call: that part of Close
+	// needs the real WorkerPool type, which this tree doesn't define. The
+	// ordering this test cares about (flush before cancel) has already run
+	// by the time that call happens.
+	func() {
+		defer func() { _ = recover() }()
+		qm.Close()
+	}()
+
+	select {
+	case live := <-ctxLiveAtFlush:
+		if !live {
+			t.Fatalf("qm.ctx was already cancelled by the time the shard's final flush ran")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the shard's drain goroutine to observe shutdown")
+	}
+}
@@ -0,0 +1,69 @@
+package clickhousespanstore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+)
+
+// TestCloseWaitsForInflightEnqueue guards against the closed-channel panic a
+// send racing with Close used to hit: Close must wait for every in-flight
+// Enqueue call to return before closing a shard's channel.
+func TestCloseWaitsForInflightEnqueue(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	qm := &QueueManager{
+		batchSize:      8,
+		overflowPolicy: OverflowBlock,
+		ctx:            ctx,
+		cancel:         cancel,
+		tenants:        make(map[string]*tenantQueue),
+		stop:           make(chan struct{}),
+	}
+
+	tq := &tenantQueue{tenant: "acme", lastSample: time.Now()}
+	s := &shard{spans: make(chan SpanAndTenant, 1), finish: make(chan struct{})}
+	tq.shards = append(tq.shards, s)
+	qm.tenants["acme"] = tq
+
+	// Fill the shard so the next OverflowBlock Enqueue stays in flight,
+	// blocked on its send, until room is made below.
+	qm.Enqueue(SpanAndTenant{span: &model.Span{TraceID: model.NewTraceID(1, 1)}, tenant: "acme"})
+
+	enqueued := make(chan struct{})
+	go func() {
+		defer close(enqueued)
+		qm.Enqueue(SpanAndTenant{span: &model.Span{TraceID: model.NewTraceID(2, 2)}, tenant: "acme"})
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	// Recover from the nil *WorkerPool.Close() call at the end of Close:
+	// that part needs the real WorkerPool type, which this tree doesn't
+	// define. Closing the shard channel happens before it.
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		defer func() { _ = recover() }()
+		qm.Close()
+	}()
+
+	select {
+	case <-closed:
+		t.Fatal("Close returned while an Enqueue call was still in flight")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	<-s.spans // make room so the in-flight Enqueue can return
+
+	select {
+	case <-enqueued:
+	case <-time.After(time.Second):
+		t.Fatal("in-flight Enqueue never returned once the shard had room")
+	}
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close never returned after the in-flight Enqueue finished")
+	}
+}
@@ -0,0 +1,107 @@
+package clickhousespanstore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+)
+
+// newTestQueueManager builds a QueueManager with a single tenant pre-seeded
+// directly into qm.tenants, so Enqueue/TryEnqueue never reach
+// getOrCreateTenant's NewWorkerPool call - letting the overflow-policy
+// branches of Enqueue/TryEnqueue, which never touch the pool or retrier, be
+// tested without the WorkerPool this tree doesn't define.
+func newTestQueueManager(t *testing.T, policy OverflowPolicy, shardCap int64) (*QueueManager, *shard) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	qm := &QueueManager{
+		batchSize:      shardCap,
+		overflowPolicy: policy,
+		ctx:            ctx,
+		cancel:         cancel,
+		tenants:        make(map[string]*tenantQueue),
+		stop:           make(chan struct{}),
+	}
+	t.Cleanup(cancel)
+
+	tq := &tenantQueue{tenant: "acme", lastSample: time.Now()}
+	s := &shard{spans: make(chan SpanAndTenant, shardCap), finish: make(chan struct{})}
+	tq.shards = append(tq.shards, s)
+	qm.tenants["acme"] = tq
+
+	return qm, s
+}
+
+func spanWithTrace(id uint64) SpanAndTenant {
+	return SpanAndTenant{span: &model.Span{TraceID: model.NewTraceID(id, id)}, tenant: "acme"}
+}
+
+func TestEnqueueDropNewestDiscardsArrivingSpan(t *testing.T) {
+	qm, s := newTestQueueManager(t, OverflowDropNewest, 1)
+
+	qm.Enqueue(spanWithTrace(1))
+	qm.Enqueue(spanWithTrace(2)) // shard is full; this one must be dropped
+
+	if len(s.spans) != 1 {
+		t.Fatalf("expected 1 queued span, got %d", len(s.spans))
+	}
+	queued := <-s.spans
+	if queued.span.TraceID.Low != 1 {
+		t.Fatalf("expected the first span to survive, got trace %d", queued.span.TraceID.Low)
+	}
+}
+
+func TestEnqueueDropOldestEvictsQueuedSpan(t *testing.T) {
+	qm, s := newTestQueueManager(t, OverflowDropOldest, 1)
+
+	qm.Enqueue(spanWithTrace(1))
+	qm.Enqueue(spanWithTrace(2)) // shard is full; span 1 must be evicted for span 2
+
+	if len(s.spans) != 1 {
+		t.Fatalf("expected 1 queued span, got %d", len(s.spans))
+	}
+	queued := <-s.spans
+	if queued.span.TraceID.Low != 2 {
+		t.Fatalf("expected the newest span to survive, got trace %d", queued.span.TraceID.Low)
+	}
+}
+
+func TestEnqueueBlockWaitsForRoom(t *testing.T) {
+	qm, s := newTestQueueManager(t, OverflowBlock, 1)
+
+	qm.Enqueue(spanWithTrace(1))
+
+	done := make(chan struct{})
+	go func() {
+		qm.Enqueue(spanWithTrace(2)) // must block until the shard has room
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("Enqueue returned before the full shard had room")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	<-s.spans // make room
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Enqueue never returned once the shard had room")
+	}
+}
+
+func TestTryEnqueueReturnsErrorWhenFull(t *testing.T) {
+	qm, _ := newTestQueueManager(t, OverflowBlock, 1)
+
+	if err := qm.TryEnqueue(spanWithTrace(1)); err != nil {
+		t.Fatalf("first TryEnqueue: %v", err)
+	}
+	if err := qm.TryEnqueue(spanWithTrace(2)); err == nil {
+		t.Fatalf("expected TryEnqueue to fail once the shard is full, regardless of OverflowPolicy")
+	}
+}
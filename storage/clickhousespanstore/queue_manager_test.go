@@ -0,0 +1,44 @@
+package clickhousespanstore
+
+import (
+	"testing"
+
+	"github.com/jaegertracing/jaeger/model"
+)
+
+// TestShardForDistributesAcrossShards guards against shardFor routing every
+// span for a tenant onto the same shard: with N shards, spans whose trace
+// IDs differ should spread across more than one of them.
+func TestShardForDistributesAcrossShards(t *testing.T) {
+	const numShards = 4
+	counts := make([]int, numShards)
+
+	for i := uint64(0); i < 200; i++ {
+		span := &model.Span{TraceID: model.NewTraceID(i, i*31+7)}
+		idx := int(spanHash(span) % uint64(numShards))
+		counts[idx]++
+	}
+
+	hit := 0
+	for _, c := range counts {
+		if c > 0 {
+			hit++
+		}
+	}
+	if hit < 2 {
+		t.Fatalf("expected spans to spread across multiple shards, but only %d/%d shards received any traffic: %v", hit, numShards, counts)
+	}
+}
+
+// TestSpanHashSameTraceSameShard verifies spans belonging to the same trace
+// still land on the same shard, so a trace's spans stay ordered relative to
+// each other within a tenant's shard set.
+func TestSpanHashSameTraceSameShard(t *testing.T) {
+	traceID := model.NewTraceID(42, 99)
+	a := spanHash(&model.Span{TraceID: traceID, SpanID: model.NewSpanID(1)})
+	b := spanHash(&model.Span{TraceID: traceID, SpanID: model.NewSpanID(2)})
+
+	if a != b {
+		t.Fatalf("spans from the same trace hashed to different shard keys: %d vs %d", a, b)
+	}
+}
@@ -0,0 +1,229 @@
+package clickhousespanstore
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// RetryConfig configures the backoff applied to a batch INSERT that fails
+// before the batch is forwarded to the dead-letter table. The dead-letter
+// table itself is not configured here: it is always `<spans_table>_dlq`.
+type RetryConfig struct {
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	MaxAttempts int
+	Jitter      float64
+}
+
+// DefaultRetryConfig matches what most operators want out of the box: a
+// handful of quick retries before giving up on a batch.
+var DefaultRetryConfig = RetryConfig{
+	BaseDelay:   100 * time.Millisecond,
+	MaxDelay:    10 * time.Second,
+	MaxAttempts: 5,
+	Jitter:      0.2,
+}
+
+var (
+	writeRetriesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "jaeger_clickhouse_write_retries_total",
+		Help: "Number of times a batch INSERT was retried after a failed attempt",
+	})
+	writeFailuresTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "jaeger_clickhouse_write_failures_total",
+		Help: "Number of batch INSERTs that failed even after all retries",
+	})
+	dlqWritesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "jaeger_clickhouse_dlq_writes_total",
+		Help: "Number of batches forwarded to the dead-letter table",
+	})
+)
+
+var registerRetryMetrics sync.Once
+
+// retryingWriter wraps a WorkerPool's batch INSERT with exponential backoff
+// and, once attempts are exhausted, forwards the batch to a dead-letter
+// table so operators can investigate or replay it later.
+type retryingWriter struct {
+	pool     *WorkerPool
+	dlq      *dlqWriter
+	cfg      RetryConfig
+	logger   hclog.Logger
+	encoding Encoding
+	encoder  Encoder
+}
+
+func newRetryingWriter(pool *WorkerPool, dlq *dlqWriter, cfg RetryConfig, logger hclog.Logger, encoding Encoding, encoder Encoder) *retryingWriter {
+	registerRetryMetrics.Do(func() {
+		prometheus.MustRegister(writeRetriesTotal, writeFailuresTotal, dlqWritesTotal)
+	})
+
+	return &retryingWriter{pool: pool, dlq: dlq, cfg: cfg, logger: logger, encoding: encoding, encoder: encoder}
+}
+
+// WriteBatch retries pool.WriteBatch with exponential backoff and jitter
+// until it succeeds, ctx is cancelled, or cfg.MaxAttempts is reached. On
+// final failure the batch is handed to the dead-letter table and the
+// original error is returned so the caller (the WAL ack path) knows not to
+// truncate the records.
+//
+// The batch is encoded and compressed once, up front, with the configured
+// Encoding/Compression, and that payload is handed to the pool, alongside
+// the batch itself, on every attempt: compressing inside the retry loop
+// would otherwise redo the same work on every retry, and leaving compression
+// to the pool itself would mean the codec configured on the writer is never
+// actually applied to a batch that succeeds.
+func (r *retryingWriter) WriteBatch(ctx context.Context, batch []SpanAndTenant) error {
+	payload, err := encodeBatchPayload(batch, r.encoding)
+	if err != nil {
+		return fmt.Errorf("encode batch: %w", err)
+	}
+	compressed := compressBatch(r.encoder, payload)
+
+	var lastErr error
+	delay := r.cfg.BaseDelay
+
+	for attempt := 1; attempt <= r.cfg.MaxAttempts; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		lastErr = r.pool.WriteBatch(batch, compressed)
+		if lastErr == nil {
+			return nil
+		}
+
+		r.logger.Warn("Batch INSERT failed", "attempt", attempt, "error", lastErr)
+
+		if attempt == r.cfg.MaxAttempts {
+			break
+		}
+
+		writeRetriesTotal.Inc()
+		sleep := jitter(delay, r.cfg.Jitter)
+		select {
+		case <-time.After(sleep):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		delay *= 2
+		if delay > r.cfg.MaxDelay {
+			delay = r.cfg.MaxDelay
+		}
+	}
+
+	writeFailuresTotal.Inc()
+	if r.dlq != nil {
+		if err := r.dlq.Write(ctx, batch, lastErr, r.encoder); err != nil {
+			r.logger.Error("Failed to write batch to dead-letter table", "error", err)
+		} else {
+			dlqWritesTotal.Inc()
+		}
+	}
+
+	return fmt.Errorf("batch INSERT failed after %d attempts: %w", r.cfg.MaxAttempts, lastErr)
+}
+
+func jitter(d time.Duration, fraction float64) time.Duration {
+	if fraction <= 0 {
+		return d
+	}
+	delta := float64(d) * fraction
+	return d + time.Duration(delta*(rand.Float64()*2-1))
+}
+
+// dlqWriter stores batches that exhausted their retries in
+// `<spans_table>_dlq`: the (optionally compressed) encoded payload, the
+// error that caused the drop, and the time it happened.
+type dlqWriter struct {
+	db    *sql.DB
+	table TableName
+}
+
+func newDLQWriter(db *sql.DB, spansTable TableName) *dlqWriter {
+	return &dlqWriter{db: db, table: spansTable + "_dlq"}
+}
+
+func (d *dlqWriter) Write(ctx context.Context, batch []SpanAndTenant, cause error, encoder Encoder) error {
+	query := fmt.Sprintf("INSERT INTO %s (payload, tenant, error, timestamp) VALUES (?, ?, ?, ?)", d.table)
+
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("dlq: begin tx: %w", err)
+	}
+
+	stmt, err := tx.PrepareContext(ctx, query)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("dlq: prepare: %w", err)
+	}
+	defer stmt.Close()
+
+	now := time.Now()
+	for _, st := range batch {
+		payload, err := encodeSpanForDLQ(st.span, encoder)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("dlq: encode span: %w", err)
+		}
+		if _, err := stmt.ExecContext(ctx, payload, st.tenant, cause.Error(), now); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("dlq: insert: %w", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// encodeSpanForDLQ marshals span and, when encoder is non-nil, compresses it
+// with the same Encoder the tenant's writes to ClickHouse use, so a batch
+// that exhausted its retries doesn't cost more disk in the dead-letter
+// table than it would have in ClickHouse.
+func encodeSpanForDLQ(span *model.Span, encoder Encoder) ([]byte, error) {
+	payload, err := proto.Marshal(span)
+	if err != nil {
+		return nil, err
+	}
+	return compressBatch(encoder, payload), nil
+}
+
+// encodeBatchPayload serializes every span in batch, length-prefixed, into a
+// single payload using the given Encoding. This is what actually gets
+// compressed before reaching the ClickHouse driver - marshaling the whole
+// batch once here, rather than leaving per-span marshaling to the pool,
+// is what lets WriteBatch compress it before the INSERT instead of only the
+// dead-letter fallback ever seeing compressed bytes.
+func encodeBatchPayload(batch []SpanAndTenant, encoding Encoding) ([]byte, error) {
+	var out []byte
+	for _, st := range batch {
+		spanBytes, err := marshalSpan(st.span, encoding)
+		if err != nil {
+			return nil, fmt.Errorf("marshal span: %w", err)
+		}
+		out = appendUint32(out, uint32(len(spanBytes)))
+		out = append(out, spanBytes...)
+	}
+	return out, nil
+}
+
+func marshalSpan(span *model.Span, encoding Encoding) ([]byte, error) {
+	if encoding == EncodingJSON {
+		return json.Marshal(span)
+	}
+	return proto.Marshal(span)
+}
+
+func appendUint32(dst []byte, v uint32) []byte {
+	return append(dst, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
@@ -0,0 +1,148 @@
+package wal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/jaegertracing/jaeger/model"
+)
+
+// Replay reads every segment under dir in id order and returns the records
+// they still hold, each tagged with the Ref of the segment it came from. It
+// is called once, from NewSpanWriter, to requeue spans that were accepted
+// before a restart or a ClickHouse outage but never confirmed written.
+//
+// A segment whose tail is truncated mid-record (e.g. from a crash during an
+// append) is read up to the last complete, CRC-valid record; the partial
+// tail is discarded rather than treated as an error.
+func Replay(dir string) ([]ReplayedRecord, error) {
+	ids, err := listSegmentIDs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []ReplayedRecord
+	for _, id := range ids {
+		recs, err := replaySegment(filepath.Join(dir, segmentFileName(id)), id)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, recs...)
+	}
+	return records, nil
+}
+
+func replaySegment(path string, id uint64) ([]ReplayedRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("wal: open segment %s: %w", path, err)
+	}
+	defer f.Close()
+
+	var records []ReplayedRecord
+	header := make([]byte, recordHeaderSize)
+	for {
+		if _, err := io.ReadFull(f, header); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return nil, fmt.Errorf("wal: read header in %s: %w", path, err)
+		}
+
+		length := binary.BigEndian.Uint32(header[0:4])
+		wantCRC := binary.BigEndian.Uint32(header[4:8])
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(f, payload); err != nil {
+			// Truncated final record: stop replaying this segment.
+			break
+		}
+		if crc32.ChecksumIEEE(payload) != wantCRC {
+			break
+		}
+
+		rec, err := decodeRecord(payload)
+		if err != nil {
+			break
+		}
+		records = append(records, ReplayedRecord{Record: rec, Ref: Ref{SegmentID: id}})
+	}
+	return records, nil
+}
+
+func decodeRecord(payload []byte) (Record, error) {
+	if len(payload) < 4 {
+		return Record{}, fmt.Errorf("wal: payload too short")
+	}
+	tenantLen := binary.BigEndian.Uint32(payload[0:4])
+	payload = payload[4:]
+	if uint32(len(payload)) < tenantLen {
+		return Record{}, fmt.Errorf("wal: truncated tenant")
+	}
+	tenant := string(payload[:tenantLen])
+	payload = payload[tenantLen:]
+
+	if len(payload) < 4 {
+		return Record{}, fmt.Errorf("wal: payload too short")
+	}
+	spanLen := binary.BigEndian.Uint32(payload[0:4])
+	payload = payload[4:]
+	if uint32(len(payload)) < spanLen {
+		return Record{}, fmt.Errorf("wal: truncated span")
+	}
+
+	var span model.Span
+	if err := proto.Unmarshal(payload[:spanLen], &span); err != nil {
+		return Record{}, fmt.Errorf("wal: unmarshal span: %w", err)
+	}
+
+	return Record{Tenant: tenant, Span: &span}, nil
+}
+
+// countRecords scans path the same way replaySegment does, discarding a
+// truncated or corrupt tail, and returns how many valid records it holds.
+// Writer uses this at startup so a segment's pending count (and therefore
+// Ack's ability to eventually delete it) reflects what Replay will actually
+// hand back to the caller.
+func countRecords(path string) (int, error) {
+	recs, err := replaySegment(path, 0)
+	if err != nil {
+		return 0, err
+	}
+	return len(recs), nil
+}
+
+// listSegmentIDs returns every segment id present under dir, sorted
+// ascending, which is also their append order.
+func listSegmentIDs(dir string) ([]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("wal: read dir %s: %w", dir, err)
+	}
+
+	var ids []uint64
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasSuffix(name, ".wal") {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, ".wal"), 10, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
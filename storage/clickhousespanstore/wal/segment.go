@@ -0,0 +1,92 @@
+// Package wal implements a write-ahead log for spans accepted by
+// SpanWriter.WriteSpan but not yet durably committed to ClickHouse. Segments
+// are rotated by size and replayed on startup so an operator restart or a
+// ClickHouse outage doesn't silently drop in-flight spans.
+package wal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+)
+
+// recordHeaderSize is the length-prefix (4 bytes) plus the CRC32 (4 bytes)
+// that precede every record's payload.
+const recordHeaderSize = 8
+
+// segmentFileName returns the on-disk name of segment id, ordered so a
+// directory listing replays in append order.
+func segmentFileName(id uint64) string {
+	return fmt.Sprintf("%020d.wal", id)
+}
+
+// segment is a single rotating WAL file. Records are appended sequentially
+// and framed as: 4-byte big-endian length, 4-byte CRC32(IEEE) of the
+// payload, then the payload itself (a length-prefixed protobuf-encoded
+// model.Span plus its tenant, see Record).
+type segment struct {
+	id      uint64
+	path    string
+	file    *os.File
+	size    int64
+	pending int // records appended but not yet acked as committed
+}
+
+func openSegment(dir string, id uint64) (*segment, error) {
+	path := filepath.Join(dir, segmentFileName(id))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("wal: open segment %s: %w", path, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("wal: stat segment %s: %w", path, err)
+	}
+	return &segment{id: id, path: path, file: f, size: info.Size()}, nil
+}
+
+func (s *segment) appendRecord(payload []byte) error {
+	header := make([]byte, recordHeaderSize)
+	binary.BigEndian.PutUint32(header[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(header[4:8], crc32.ChecksumIEEE(payload))
+
+	n, err := s.file.Write(append(header, payload...))
+	if err != nil {
+		return fmt.Errorf("wal: append to segment %s: %w", s.path, err)
+	}
+	s.size += int64(n)
+	s.pending++
+	return nil
+}
+
+// openExistingForAck opens a segment that predates this process (found on
+// disk at startup) and sets its pending count to the number of valid
+// records it holds, so Ack can later recognize when every one of them has
+// been committed and delete the file. Without this, a segment written by a
+// previous run would never be tracked in Writer.segments and Ack would have
+// nothing to decrement, leaking the file on disk forever.
+func openExistingForAck(dir string, id uint64) (*segment, error) {
+	s, err := openSegment(dir, id)
+	if err != nil {
+		return nil, err
+	}
+	pending, err := countRecords(s.path)
+	if err != nil {
+		s.file.Close()
+		return nil, err
+	}
+	s.pending = pending
+	return s, nil
+}
+
+func (s *segment) close() error {
+	return s.file.Close()
+}
+
+func (s *segment) remove() error {
+	s.file.Close()
+	return os.Remove(s.path)
+}
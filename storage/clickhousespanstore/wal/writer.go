@@ -0,0 +1,250 @@
+package wal
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DropPolicy decides what happens to new writes once the WAL backlog
+// exceeds Config.MaxBacklog.
+type DropPolicy string
+
+const (
+	// DropPolicyRejectNewest refuses the Append call with an error, which
+	// SpanWriter returns to its own caller without enqueueing the span.
+	DropPolicyRejectNewest DropPolicy = "reject_newest"
+	// DropPolicyDropOldest deletes the oldest un-acked segment to make
+	// room, losing the spans it still held.
+	DropPolicyDropOldest DropPolicy = "drop_oldest"
+)
+
+// Config configures the WAL. It is populated from the `wal.*` options on
+// the SpanWriter.
+type Config struct {
+	Enabled     bool
+	Dir         string
+	SegmentSize int64
+	MaxBacklog  int64
+	DropPolicy  DropPolicy
+}
+
+// Ref identifies a record's segment so its Writer can later Ack it once the
+// batch it belongs to has been durably written to ClickHouse.
+type Ref struct {
+	SegmentID uint64
+}
+
+// Record is what gets framed and appended to a segment.
+type Record struct {
+	Tenant string
+	Span   *model.Span
+}
+
+// ReplayedRecord is a Record read back by Replay, together with the Ref
+// identifying the segment it actually came from. Replay's caller must Ack
+// against this Ref, not a synthesized one, or the originating segment's
+// pending count never reaches zero and it is replayed forever.
+type ReplayedRecord struct {
+	Record
+	Ref Ref
+}
+
+var walDropped = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "jaeger_clickhouse_wal_dropped_total",
+	Help: "Number of spans dropped from the write-ahead log due to backlog limits",
+})
+
+var registerWalMetrics sync.Once
+
+// Writer appends records to rotating segment files and truncates (deletes)
+// a segment once every record it holds has been Acked.
+type Writer struct {
+	cfg Config
+
+	mu       sync.Mutex
+	active   *segment
+	segments []*segment // non-active segments with still-unacked records
+	nextID   uint64
+	backlog  int64
+}
+
+// NewWriter opens (or creates) the WAL directory and starts a fresh active
+// segment continuing from the highest segment id already on disk.
+func NewWriter(cfg Config) (*Writer, error) {
+	registerWalMetrics.Do(func() {
+		prometheus.MustRegister(walDropped)
+	})
+
+	if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("wal: create dir %s: %w", cfg.Dir, err)
+	}
+
+	ids, err := listSegmentIDs(cfg.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var nextID uint64
+	var segments []*segment
+	if len(ids) > 0 {
+		nextID = ids[len(ids)-1] + 1
+		for _, id := range ids {
+			s, err := openExistingForAck(cfg.Dir, id)
+			if err != nil {
+				return nil, err
+			}
+			segments = append(segments, s)
+		}
+	}
+
+	active, err := openSegment(cfg.Dir, nextID)
+	if err != nil {
+		return nil, err
+	}
+
+	var backlog int64
+	for _, s := range segments {
+		backlog += int64(s.pending)
+	}
+
+	return &Writer{cfg: cfg, active: active, segments: segments, nextID: nextID + 1, backlog: backlog}, nil
+}
+
+// Append encodes rec and writes it to the active segment, rotating to a new
+// segment first if the active one has grown past Config.SegmentSize. It
+// returns a Ref the caller must later pass to Ack once the record's batch
+// is durably committed.
+func (w *Writer) Append(rec Record) (Ref, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.cfg.MaxBacklog > 0 && w.backlog >= w.cfg.MaxBacklog {
+		switch w.cfg.DropPolicy {
+		case DropPolicyDropOldest:
+			if err := w.evictOldestLocked(); err != nil {
+				return Ref{}, err
+			}
+		default:
+			walDropped.Inc()
+			return Ref{}, fmt.Errorf("wal: backlog limit (%d) exceeded", w.cfg.MaxBacklog)
+		}
+	}
+
+	payload, err := encodeRecord(rec)
+	if err != nil {
+		return Ref{}, err
+	}
+
+	if w.cfg.SegmentSize > 0 && w.active.size+int64(len(payload)+recordHeaderSize) > w.cfg.SegmentSize {
+		if err := w.rotateLocked(); err != nil {
+			return Ref{}, err
+		}
+	}
+
+	if err := w.active.appendRecord(payload); err != nil {
+		return Ref{}, err
+	}
+	w.backlog++
+
+	return Ref{SegmentID: w.active.id}, nil
+}
+
+// evictOldestLocked deletes the oldest non-active segment to make room for
+// new writes, dropping every record it still held. If there is no older
+// segment to evict yet (e.g. SegmentSize is unset, or the active segment
+// hasn't grown past it yet), it forces a rotation first so the active
+// segment itself - holding every record written so far - becomes the one
+// that gets evicted. Without this, MaxBacklog would go unenforced until a
+// size-based rotation happened to occur on its own.
+func (w *Writer) evictOldestLocked() error {
+	if len(w.segments) == 0 {
+		if err := w.rotateLocked(); err != nil {
+			return err
+		}
+	}
+
+	oldest := w.segments[0]
+	w.segments = w.segments[1:]
+	walDropped.Add(float64(oldest.pending))
+	w.backlog -= int64(oldest.pending)
+	if w.backlog < 0 {
+		w.backlog = 0
+	}
+	return oldest.remove()
+}
+
+func (w *Writer) rotateLocked() error {
+	old := w.active
+	next, err := openSegment(w.cfg.Dir, w.nextID)
+	if err != nil {
+		return err
+	}
+	w.nextID++
+	w.active = next
+	w.segments = append(w.segments, old)
+	return nil
+}
+
+// Ack marks count records in ref's segment as durably committed. Once a
+// non-active segment has had every appended record acked, it is deleted.
+func (w *Writer) Ack(ref Ref, count int) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.backlog -= int64(count)
+	if w.backlog < 0 {
+		w.backlog = 0
+	}
+
+	if ref.SegmentID == w.active.id {
+		w.active.pending -= count
+		return nil
+	}
+
+	for i, s := range w.segments {
+		if s.id != ref.SegmentID {
+			continue
+		}
+		s.pending -= count
+		if s.pending <= 0 {
+			if err := s.remove(); err != nil {
+				return err
+			}
+			w.segments = append(w.segments[:i], w.segments[i+1:]...)
+		}
+		return nil
+	}
+	return nil
+}
+
+// Close closes the active segment. Un-acked, non-active segments are left
+// on disk deliberately: they are replayed by Replay on the next startup.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.active.close()
+}
+
+func encodeRecord(rec Record) ([]byte, error) {
+	spanBytes, err := proto.Marshal(rec.Span)
+	if err != nil {
+		return nil, fmt.Errorf("wal: marshal span: %w", err)
+	}
+
+	tenant := []byte(rec.Tenant)
+	out := make([]byte, 0, 4+len(tenant)+4+len(spanBytes))
+	out = appendUint32(out, uint32(len(tenant)))
+	out = append(out, tenant...)
+	out = appendUint32(out, uint32(len(spanBytes)))
+	out = append(out, spanBytes...)
+	return out, nil
+}
+
+func appendUint32(dst []byte, v uint32) []byte {
+	return append(dst, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
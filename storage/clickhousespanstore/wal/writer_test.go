@@ -0,0 +1,192 @@
+package wal
+
+import (
+	"testing"
+
+	"github.com/jaegertracing/jaeger/model"
+)
+
+func testRecord(tenant string) Record {
+	return Record{
+		Tenant: tenant,
+		Span: &model.Span{
+			TraceID:       model.NewTraceID(1, 2),
+			SpanID:        model.NewSpanID(3),
+			OperationName: "op",
+		},
+	}
+}
+
+func TestAppendReplayAck(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewWriter(Config{Enabled: true, Dir: dir})
+	if err != nil {
+		t.Fatalf("NewWriter: %v", err)
+	}
+
+	ref, err := w.Append(testRecord("acme"))
+	if err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	replayed, err := Replay(dir)
+	if err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+	if len(replayed) != 1 {
+		t.Fatalf("expected 1 replayed record, got %d", len(replayed))
+	}
+	if replayed[0].Ref != ref {
+		t.Fatalf("replayed ref %+v does not match the ref Append returned %+v", replayed[0].Ref, ref)
+	}
+	if replayed[0].Tenant != "acme" {
+		t.Fatalf("unexpected tenant %q", replayed[0].Tenant)
+	}
+
+	// Reopen the WAL and ack the record against the ref Replay gave us:
+	// the segment the record actually lives in, not the reopened writer's
+	// new active segment.
+	w2, err := NewWriter(Config{Enabled: true, Dir: dir})
+	if err != nil {
+		t.Fatalf("NewWriter (reopen): %v", err)
+	}
+	if err := w2.Ack(replayed[0].Ref, 1); err != nil {
+		t.Fatalf("Ack: %v", err)
+	}
+	if err := w2.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// The acked segment should be gone, so a fresh replay finds nothing.
+	replayedAgain, err := Replay(dir)
+	if err != nil {
+		t.Fatalf("Replay after ack: %v", err)
+	}
+	if len(replayedAgain) != 0 {
+		t.Fatalf("expected 0 records after ack, got %d", len(replayedAgain))
+	}
+}
+
+func TestAppendRotatesBySize(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewWriter(Config{Enabled: true, Dir: dir, SegmentSize: 1})
+	if err != nil {
+		t.Fatalf("NewWriter: %v", err)
+	}
+	defer w.Close()
+
+	first, err := w.Append(testRecord("a"))
+	if err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	second, err := w.Append(testRecord("b"))
+	if err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+
+	if first.SegmentID == second.SegmentID {
+		t.Fatalf("expected SegmentSize: 1 to force a rotation, both records landed in segment %d", first.SegmentID)
+	}
+}
+
+func TestDropPolicyDropOldestEvictsOldSegment(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewWriter(Config{Enabled: true, Dir: dir, MaxBacklog: 2, DropPolicy: DropPolicyDropOldest})
+	if err != nil {
+		t.Fatalf("NewWriter: %v", err)
+	}
+	defer w.Close()
+
+	first, err := w.Append(testRecord("a"))
+	if err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+
+	// Force a rotation so the segment holding "first" becomes a non-active,
+	// evictable segment rather than the one Append keeps growing.
+	w.mu.Lock()
+	err = w.rotateLocked()
+	w.mu.Unlock()
+	if err != nil {
+		t.Fatalf("rotateLocked: %v", err)
+	}
+
+	if _, err := w.Append(testRecord("b")); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	// Backlog is now at MaxBacklog (2), so this Append must evict the
+	// oldest segment - the one holding "first" - rather than just
+	// recording the drop and leaving it on disk.
+	if _, err := w.Append(testRecord("c")); err != nil {
+		t.Fatalf("Append over backlog limit with DropPolicyDropOldest should not error, got: %v", err)
+	}
+
+	replayed, err := Replay(dir)
+	if err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+	for _, rec := range replayed {
+		if rec.Ref.SegmentID == first.SegmentID {
+			t.Fatalf("segment %d should have been evicted by DropPolicyDropOldest, but its record is still on disk", first.SegmentID)
+		}
+	}
+}
+
+func TestDropPolicyDropOldestEnforcesBacklogBeforeFirstRotation(t *testing.T) {
+	dir := t.TempDir()
+	// SegmentSize is left unset (0, meaning "never rotate by size"), so
+	// nothing ever pushes the active segment into w.segments on its own -
+	// exactly the case where evictOldestLocked used to silently let
+	// MaxBacklog go unenforced.
+	w, err := NewWriter(Config{Enabled: true, Dir: dir, MaxBacklog: 2, DropPolicy: DropPolicyDropOldest})
+	if err != nil {
+		t.Fatalf("NewWriter: %v", err)
+	}
+	defer w.Close()
+
+	first, err := w.Append(testRecord("a"))
+	if err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	if _, err := w.Append(testRecord("b")); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	// Backlog is now at MaxBacklog (2) with no non-active segment to evict.
+	// This Append must force a rotation and evict the segment holding
+	// "first" rather than exceeding the configured backlog.
+	if _, err := w.Append(testRecord("c")); err != nil {
+		t.Fatalf("Append over backlog limit with DropPolicyDropOldest should not error, got: %v", err)
+	}
+
+	replayed, err := Replay(dir)
+	if err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+	if len(replayed) > 2 {
+		t.Fatalf("expected MaxBacklog (2) to be enforced, found %d records on disk", len(replayed))
+	}
+	for _, rec := range replayed {
+		if rec.Ref.SegmentID == first.SegmentID {
+			t.Fatalf("segment %d should have been evicted by DropPolicyDropOldest, but its record is still on disk", first.SegmentID)
+		}
+	}
+}
+
+func TestDropPolicyRejectNewest(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewWriter(Config{Enabled: true, Dir: dir, MaxBacklog: 1, DropPolicy: DropPolicyRejectNewest})
+	if err != nil {
+		t.Fatalf("NewWriter: %v", err)
+	}
+	defer w.Close()
+
+	if _, err := w.Append(testRecord("a")); err != nil {
+		t.Fatalf("first Append: %v", err)
+	}
+	if _, err := w.Append(testRecord("b")); err == nil {
+		t.Fatalf("expected second Append to be rejected once MaxBacklog is reached")
+	}
+}
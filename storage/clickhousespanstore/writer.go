@@ -3,14 +3,14 @@ package clickhousespanstore
 import (
 	"context"
 	"database/sql"
-	"sync"
 	"time"
 
 	hclog "github.com/hashicorp/go-hclog"
 	"github.com/jaegertracing/jaeger/model"
 	"github.com/jaegertracing/jaeger/storage/spanstore"
-	"github.com/prometheus/client_golang/prometheus"
 	"google.golang.org/grpc/metadata"
+
+	"github.com/jaegertracing/jaeger-clickhouse/storage/clickhousespanstore/wal"
 )
 
 type Encoding string
@@ -22,33 +22,23 @@ const (
 	EncodingProto Encoding = "protobuf"
 )
 
-var (
-	numWritesWithBatchSize = prometheus.NewCounter(prometheus.CounterOpts{
-		Name: "jaeger_clickhouse_writes_with_batch_size_total",
-		Help: "Number of clickhouse writes due to batch size criteria",
-	})
-	numWritesWithFlushInterval = prometheus.NewCounter(prometheus.CounterOpts{
-		Name: "jaeger_clickhouse_writes_with_flush_interval_total",
-		Help: "Number of clickhouse writes due to flush interval criteria",
-	})
-)
-
 type SpanAndTenant struct {
 	span   *model.Span
 	tenant string
+	walRef wal.Ref
 }
 
-// SpanWriter for writing spans to ClickHouse
+// SpanWriter for writing spans to ClickHouse. Each tenant is drained by its
+// own set of shards, managed by a QueueManager, so a single noisy tenant
+// can't starve the others on a shared queue.
 type SpanWriter struct {
 	workerParams WorkerParams
 
 	size   int64
-	spans  chan SpanAndTenant
-	finish chan bool
-	done   sync.WaitGroup
+	queues *QueueManager
+	wal    *wal.Writer
 }
 
-var registerWriterMetrics sync.Once
 var _ spanstore.Writer = (*SpanWriter)(nil)
 
 // NewSpanWriter returns a SpanWriter for the database
@@ -62,105 +52,133 @@ func NewSpanWriter(
 	delay time.Duration,
 	size int64,
 	maxSpanCount int,
-) *SpanWriter {
+	walConfig wal.Config,
+	retryConfig RetryConfig,
+	overflowPolicy OverflowPolicy,
+	compression Compression,
+) (*SpanWriter, error) {
+	encoder, err := NewEncoder(compression)
+	if err != nil {
+		return nil, err
+	}
+
 	writer := &SpanWriter{
 		workerParams: WorkerParams{
-			logger:     logger,
-			db:         db,
-			indexTable: indexTable,
-			spansTable: spansTable,
-			tenant:     tenant,
-			encoding:   encoding,
-			delay:      delay,
+			logger:      logger,
+			db:          db,
+			indexTable:  indexTable,
+			spansTable:  spansTable,
+			tenant:      tenant,
+			encoding:    encoding,
+			delay:       delay,
+			compression: compression,
+			encoder:     encoder,
 		},
-		size:   size,
-		spans:  make(chan SpanAndTenant, size),
-		finish: make(chan bool),
+		size: size,
+	}
+
+	var replayed []wal.ReplayedRecord
+	if walConfig.Enabled {
+		walWriter, err := wal.NewWriter(walConfig)
+		if err != nil {
+			return nil, err
+		}
+		writer.wal = walWriter
+
+		replayed, err = wal.Replay(walConfig.Dir)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	writer.registerMetrics()
-	go writer.backgroundWriter(maxSpanCount)
+	writer.queues = NewQueueManager(writer.workerParams, maxSpanCount, size, writer.wal, retryConfig, overflowPolicy)
 
-	return writer
+	for _, rec := range replayed {
+		logger.Debug("Replaying WAL record", "tenant", rec.Tenant, "segment", rec.Ref.SegmentID)
+		writer.queues.Enqueue(SpanAndTenant{span: rec.Span, tenant: rec.Tenant, walRef: rec.Ref})
+	}
+
+	return writer, nil
 }
 
-func (w *SpanWriter) registerMetrics() {
-	registerWriterMetrics.Do(func() {
-		prometheus.MustRegister(numWritesWithBatchSize)
-		prometheus.MustRegister(numWritesWithFlushInterval)
-	})
+// WriteSpan writes the encoded span, appending it to the write-ahead log
+// first (when enabled) so it survives a crash or ClickHouse outage before
+// being durably committed. A span is always enqueued, even when the
+// incoming context carries no tenant metadata, so plugins running without
+// multi-tenancy never silently drop spans.
+func (w *SpanWriter) WriteSpan(ctx context.Context, span *model.Span) error {
+	st, err := w.prepare(tenantFromContext(ctx), span)
+	if err != nil {
+		return err
+	}
+
+	w.queues.Enqueue(st)
+	return nil
 }
 
-func (w *SpanWriter) backgroundWriter(maxSpanCount int) {
-	pool := NewWorkerPool(&w.workerParams, maxSpanCount)
-	go pool.Work()
-	batch := make([]SpanAndTenant, 0, w.size)
-
-	timer := time.After(w.workerParams.delay)
-	last := time.Now()
-
-	for {
-		w.done.Add(1)
-
-		flush := false
-		finish := false
-
-		select {
-		case span := <-w.spans:
-			batch = append(batch, span)
-			flush = len(batch) == cap(batch)
-			if flush {
-				w.workerParams.logger.Debug("Flush due to batch size", "size", len(batch))
-				numWritesWithBatchSize.Inc()
-			}
-		case <-timer:
-			timer = time.After(w.workerParams.delay)
-			flush = time.Since(last) > w.workerParams.delay && len(batch) > 0
-			if flush {
-				w.workerParams.logger.Debug("Flush due to timer")
-				numWritesWithFlushInterval.Inc()
-			}
-		case <-w.finish:
-			finish = true
-			flush = len(batch) > 0
-			w.workerParams.logger.Debug("Finish channel")
-		}
+// TryWriteSpan behaves like WriteSpan but never blocks: it returns an error
+// immediately if the span's queue is full, regardless of the configured
+// overflow policy, so callers can apply their own backpressure instead of
+// stalling on a slow ClickHouse.
+func (w *SpanWriter) TryWriteSpan(ctx context.Context, span *model.Span) error {
+	st, err := w.prepare(tenantFromContext(ctx), span)
+	if err != nil {
+		return err
+	}
 
-		if flush {
-			pool.WriteBatch(batch)
+	return w.queues.TryEnqueue(st)
+}
 
-			batch = make([]SpanAndTenant, 0, w.size)
-			last = time.Now()
+// WriteSpans enqueues a pre-formed batch of spans as a single unit,
+// skipping the per-span channel roundtrip WriteSpan goes through: the whole
+// batch reaches the tenant's WorkerPool as one INSERT instead of being
+// pushed one span at a time onto a shard channel. This is meant for
+// OTLP-style ingestion paths that already receive spans in batches
+// upstream. Because the batch is written synchronously rather than
+// queued, the writer's OverflowPolicy does not apply to it.
+func (w *SpanWriter) WriteSpans(ctx context.Context, spans []*model.Span) error {
+	tenant := tenantFromContext(ctx)
+
+	batch := make([]SpanAndTenant, 0, len(spans))
+	for _, span := range spans {
+		st, err := w.prepare(tenant, span)
+		if err != nil {
+			return err
 		}
+		batch = append(batch, st)
+	}
 
-		if finish {
-			pool.Close()
-		}
-		w.done.Done()
+	return w.queues.EnqueueBatch(tenant, batch)
+}
+
+func (w *SpanWriter) prepare(tenant string, span *model.Span) (SpanAndTenant, error) {
+	st := SpanAndTenant{span: span, tenant: tenant}
 
-		if finish {
-			break
+	if w.wal != nil {
+		ref, err := w.wal.Append(wal.Record{Tenant: tenant, Span: span})
+		if err != nil {
+			return SpanAndTenant{}, err
 		}
+		st.walRef = ref
 	}
+
+	return st, nil
 }
 
-// WriteSpan writes the encoded span
-func (w *SpanWriter) WriteSpan(ctx context.Context, span *model.Span) error {
+func tenantFromContext(ctx context.Context) string {
 	if md, ok := metadata.FromIncomingContext(ctx); ok {
-		tenants := md.Get("x-tenant")
-		if len(tenants) == 0 {
-			w.spans <- SpanAndTenant{span, ""}
-		} else {
-			w.spans <- SpanAndTenant{span, tenants[0]}
+		if tenants := md.Get("x-tenant"); len(tenants) > 0 {
+			return tenants[0]
 		}
 	}
-
-	return nil
+	return ""
 }
 
 // Close Implements io.Closer and closes the underlying storage
 func (w *SpanWriter) Close() error {
-	w.finish <- true
-	w.done.Wait()
+	w.queues.Close()
+	if w.wal != nil {
+		return w.wal.Close()
+	}
 	return nil
 }